@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOptions "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const verifyTokenTTL = 24 * time.Hour
+const resetTokenTTL = 1 * time.Hour
+
+const tokenPurposeVerify = "verify"
+const tokenPurposeReset = "reset"
+
+// tokenDoc : a single-use, purpose-scoped token backing both the email
+// verification and password reset flows. The plaintext token is only ever
+// sent over email - what's stored is its sha256, like a refresh token.
+type tokenDoc struct {
+	Hash      string    `bson:"hash"`
+	UserID    string    `bson:"userID"`
+	Purpose   string    `bson:"purpose"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// ensureTokenIndexes : TTL-indexes the "tokens" collection so stale
+// verification/reset tokens are reaped automatically.
+func ensureTokenIndexes(ctx context.Context) {
+	_, err := DB.Collection("tokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: mongoOptions.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println("Could not create tokens TTL index:", err)
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken : generates a random token, stores its hash under the given
+// purpose/ttl, and returns the plaintext to hand to the user (e.g. in an email link).
+func issueToken(ctx context.Context, userID string, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	_, err := DB.Collection("tokens").InsertOne(ctx, tokenDoc{
+		Hash:      hashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeToken : atomically looks up and deletes a matching, unexpired
+// token so it can never be used twice.
+func consumeToken(ctx context.Context, token string, purpose string) (userID string, ok bool) {
+	var doc tokenDoc
+	err := DB.Collection("tokens").FindOneAndDelete(ctx, bson.M{
+		"hash":      hashToken(token),
+		"purpose":   purpose,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&doc)
+	if err != nil {
+		return "", false
+	}
+	return doc.UserID, true
+}
+
+// Mailer : lets sendVerificationEmail/requestPasswordReset send mail without
+// hardcoding SMTP, so local development can just log the link instead.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// logMailer : the mailer for any APP_ENV other than "production" - prints the email instead of sending it.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("[mailer] to=%s subject=%q body=%s", to, subject, body)
+	return nil
+}
+
+// smtpMailer : sends real mail via net/smtp, configured through the usual SMTP_* env vars.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer() *smtpMailer {
+	host := os.Getenv("SMTP_HOST")
+	return &smtpMailer{
+		addr: host + ":" + os.Getenv("SMTP_PORT"),
+		from: os.Getenv("SMTP_FROM"),
+		auth: smtp.PlainAuth("", os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), host),
+	}
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", m.from, to, subject, body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+var mailer Mailer
+
+func init() {
+	if os.Getenv("APP_ENV") == "production" {
+		mailer = newSMTPMailer()
+	} else {
+		mailer = logMailer{}
+	}
+}
+
+// sendVerificationEmail : issues a verify token and emails the user a link
+// to confirm their address.
+func sendVerificationEmail(userID string, email string) {
+	token, err := issueToken(context.Background(), userID, tokenPurposeVerify, verifyTokenTTL)
+	if err != nil {
+		log.Println("Could not issue verification token:", err)
+		return
+	}
+
+	link := os.Getenv("CLIENT_URL") + "/verify-email?token=" + token
+	if err := mailer.Send(email, "Verify your email address", "Click to verify your email: "+link); err != nil {
+		log.Println("Could not send verification email:", err)
+	}
+}
+
+func verifyEmailHandler(res http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var body struct{ Token string }
+	if err := decoder.Decode(&body); err != nil {
+		log.Panicln(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+
+	ctx := context.Background()
+	userID, ok := consumeToken(ctx, body.Token, tokenPurposeVerify)
+	if !ok {
+		response, _ := json.Marshal(Response{false, "Invalid or expired verification link."})
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write(response)
+		return
+	}
+
+	constructedUserID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"emailVerified": true}}); err != nil {
+		log.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// keep the caller's live cookie session (if any) in sync, so
+	// /api/session stops reporting emailVerified:false without a re-login.
+	if session, sessionErr := store.Get(req, "boiler-session"); sessionErr == nil && session.Values["id"] == userID {
+		session.Values["emailVerified"] = true
+		if err := sessions.Save(req, res); err != nil {
+			log.Printf("Error saving session: %v", err)
+		}
+	}
+
+	response, _ := json.Marshal(Response{true, "Email verified."})
+	res.Write(response)
+}
+
+// resetRequestLimiter : a small in-memory rate limit on password reset
+// requests, keyed by IP and by email, so the endpoint can't be used either
+// to spam a single mailbox or to flood many mailboxes from one source.
+var resetRequestLimiter = struct {
+	sync.Mutex
+	lastRequest map[string]time.Time
+}{lastRequest: map[string]time.Time{}}
+
+const resetRequestCooldown = 1 * time.Minute
+
+func clientIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.Split(forwarded, ",")[0]
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func allowResetRequest(ip string, email string) bool {
+	resetRequestLimiter.Lock()
+	defer resetRequestLimiter.Unlock()
+
+	for _, key := range []string{"ip:" + ip, "email:" + email} {
+		if last, ok := resetRequestLimiter.lastRequest[key]; ok && time.Since(last) < resetRequestCooldown {
+			return false
+		}
+	}
+	resetRequestLimiter.lastRequest["ip:"+ip] = time.Now()
+	resetRequestLimiter.lastRequest["email:"+email] = time.Now()
+	return true
+}
+
+// requestPasswordReset : always responds with success, whether or not the
+// email is registered, so the endpoint can't be used to enumerate accounts.
+func requestPasswordReset(res http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var body struct{ Email string }
+	if err := decoder.Decode(&body); err != nil {
+		log.Panicln(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	defer func() {
+		response, _ := json.Marshal(Response{true, "If that email is registered, a reset link has been sent."})
+		res.Write(response)
+	}()
+
+	if !allowResetRequest(clientIP(req), body.Email) {
+		return
+	}
+
+	ctx := context.Background()
+	var u user
+	if err := DB.Collection("users").FindOne(ctx, bson.M{"email": body.Email}).Decode(&u); err != nil {
+		return
+	}
+
+	token, err := issueToken(ctx, u.ID.Hex(), tokenPurposeReset, resetTokenTTL)
+	if err != nil {
+		log.Println("Could not issue reset token:", err)
+		return
+	}
+
+	link := os.Getenv("CLIENT_URL") + "/reset-password?token=" + token
+	if err := mailer.Send(body.Email, "Reset your password", "Click to reset your password: "+link); err != nil {
+		log.Println("Could not send reset email:", err)
+	}
+}
+
+// resetPasswordHandler : consumes the reset token, sets the new password and
+// deletes every row the account has in the sessions collection (cookie
+// sessions and refresh tokens), since the old password (and every session
+// issued under it) can no longer be trusted. Bearer access tokens already
+// handed out are not revoked; they stay valid until they expire (accessTokenTTL).
+func resetPasswordHandler(res http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var body struct {
+		Token    string
+		Password string
+	}
+	if err := decoder.Decode(&body); err != nil {
+		log.Panicln(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+
+	ctx := context.Background()
+	userID, ok := consumeToken(ctx, body.Token, tokenPurposeReset)
+	if !ok {
+		response, _ := json.Marshal(Response{false, "Invalid or expired reset link."})
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write(response)
+		return
+	}
+
+	constructedUserID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, hashError := defaultHasher.Hash(body.Password)
+	if hashError != nil {
+		log.Panicln(hashError)
+	}
+
+	if _, err := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"password": hashedPassword}}); err != nil {
+		log.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// logout-everywhere for cookie sessions and refresh tokens: the reset
+	// proves the old password (and anything signed into under it) can no
+	// longer be trusted.
+	if _, err := DB.Collection("sessions").DeleteMany(ctx, bson.M{"userID": userID}); err != nil {
+		log.Println(err)
+	}
+
+	response, _ := json.Marshal(Response{true, "Password has been reset."})
+	res.Write(response)
+}
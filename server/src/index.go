@@ -2,21 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 // Person : stores a single person's data
@@ -32,9 +33,11 @@ type people struct {
 
 // SessionData : to send back session data
 type SessionData struct {
-	Auth        bool
-	HasPassword bool
-	Google      bool
+	Auth          bool
+	HasPassword   bool
+	Providers     map[string]bool
+	TwoFactor     bool
+	EmailVerified bool
 }
 
 type passwordChangeData struct {
@@ -54,12 +57,13 @@ type oauthProvider struct {
 }
 
 type user struct {
-	ID       primitive.ObjectID `json:"id" bson:"_id"`
-	Email    string             `json:"email" bson:"email"`
-	Password string             `json:"password" bson:"password"`
-	Google   *oauthProvider     `json:"Google" bson:"Google,omitempty"`
-	// other oauthProviders
-	Profile *profile `json:"profile" bson:"profile,omitempty"`
+	ID            primitive.ObjectID       `json:"id" bson:"_id"`
+	Email         string                   `json:"email" bson:"email"`
+	Password      string                   `json:"password" bson:"password"`
+	EmailVerified bool                     `json:"emailVerified" bson:"emailVerified"`
+	Providers     map[string]oauthProvider `json:"providers" bson:"providers,omitempty"`
+	Profile       *profile                 `json:"profile" bson:"profile,omitempty"`
+	TwoFactor     *twoFactorData           `json:"twoFactor,omitempty" bson:"twoFactor,omitempty"`
 }
 
 type oauthUserData struct {
@@ -75,43 +79,42 @@ type profile struct {
 	Picture string
 }
 
+// otc : the one-time-code a client exchanges for a linked/authenticated session
 type otc struct {
 	Code string
 }
 
-var store *sessions.CookieStore
-var googleOauthConfig *oauth2.Config
-var googleRandomState = RandStringRunes(30)
+// cachedOAuth : what gets stored under "cache" while a client redeems its OTC
+type cachedOAuth struct {
+	Email       string `bson:"email"`
+	ID          string `bson:"id"`
+	Picture     string `bson:"picture"`
+	Name        string `bson:"name"`
+	AccessToken string `bson:"accessToken"`
+	Provider    string `bson:"provider"`
+}
 
-const oauthGoogleURLAPI = "https://www.googleapis.com/oauth2/v2/userinfo?access_token="
+var store sessions.Store
 
 func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	googleOauthConfig = &oauth2.Config{
-		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
-		Endpoint:     google.Endpoint,
+	// .env is a local/deploy convenience, not a hard requirement - CI and
+	// `go test` run fine off whatever's already in the environment.
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, continuing with the process environment")
 	}
 
-	store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET1")),
+	store = newMongoStore([]byte(os.Getenv("SESSION_SECRET1")),
 		[]byte(os.Getenv("SESSION_SECRET2")))
 
-	store.Options = &sessions.Options{
-		MaxAge:   3600 * 8, // 8 hours
-		HttpOnly: true,
-	}
+	gob.Register(map[string]bool{})
 }
 
 func main() {
 
 	// setting up database
 	DBSetup()
+	ensureCacheIndexes(context.Background())
+	ensureTokenIndexes(context.Background())
 
 	// clearing cache
 	ctx := context.Background()
@@ -124,19 +127,35 @@ func main() {
 
 	// api routes
 	router.HandleFunc("/api/session", fetchSession).Methods("GET")
-	router.Handle("/api/people", onlyAuthorized(http.HandlerFunc(fetchPeople))).Methods("GET")
+	router.Handle("/api/people", onlyVerified(http.HandlerFunc(fetchPeople))).Methods("GET")
 	router.Handle("/api/auth", onlyUnauthorized(http.HandlerFunc(authorize))).Methods("POST")
 	router.Handle("/api/register", onlyUnauthorized(http.HandlerFunc(register))).Methods("POST")
 	router.Handle("/api/changePassword", onlyAuthorized(http.HandlerFunc(changePassword))).Methods("POST")
 	router.Handle("/api/logout", onlyAuthorized(http.HandlerFunc(logout))).Methods("POST")
 
+	// session management (logout-everywhere) and stateless (mobile) auth
+	router.Handle("/api/sessions", onlyAuthorized(http.HandlerFunc(fetchSessions))).Methods("GET")
+	router.Handle("/api/sessions/{sid}", onlyAuthorized(http.HandlerFunc(revokeSession))).Methods("DELETE")
+	router.HandleFunc("/api/auth/refresh", refreshTokenHandler).Methods("POST")
+
+	// two-factor authentication
+	router.Handle("/api/2fa/enroll", onlyAuthorized(http.HandlerFunc(enroll2FA))).Methods("POST")
+	router.Handle("/api/2fa/verify", onlyAuthorized(http.HandlerFunc(verify2FAEnrollment))).Methods("POST")
+	router.Handle("/api/2fa/disable", onlyAuthorized(http.HandlerFunc(disable2FA))).Methods("POST")
+	router.HandleFunc("/api/auth/2fa", completeTwoFactorLogin).Methods("POST")
+
+	// email verification and password reset
+	router.HandleFunc("/api/verifyEmail", verifyEmailHandler).Methods("POST")
+	router.HandleFunc("/api/requestPasswordReset", requestPasswordReset).Methods("POST")
+	router.HandleFunc("/api/resetPassword", resetPasswordHandler).Methods("POST")
+
 	// oauth management
 	router.HandleFunc("/api/authOTC", oauthLink).Methods("POST")
-	router.Handle("/api/google", onlyAuthorized(http.HandlerFunc(oauthGoogleUnlink))).Methods("DELETE")
+	router.Handle("/api/link/{provider}", onlyAuthorized(http.HandlerFunc(oauthUnlink))).Methods("DELETE")
 
 	// oauth linking
-	router.HandleFunc("/auth/google", oauthGoogleRedirect).Methods("GET")
-	router.HandleFunc("/callback/google", oauthGoogleCallback).Methods("GET")
+	router.HandleFunc("/auth/{provider}", oauthRedirect).Methods("GET")
+	router.HandleFunc("/callback/{provider}", oauthCallback).Methods("GET")
 
 	log.Println("Listening on port " + os.Getenv("PORT"))
 	http.ListenAndServe(":"+os.Getenv("PORT"), router)
@@ -155,6 +174,51 @@ func logout(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusOK)
 }
 
+// fetchSessions : lists the caller's active "boiler-session" logins, so a
+// user can see (and later revoke) every device/browser they're signed into.
+func fetchSessions(res http.ResponseWriter, req *http.Request) {
+	userID, _, _ := identifyRequest(req)
+
+	ctx := context.Background()
+	cursor, err := DB.Collection("sessions").Find(ctx, bson.M{"userID": userID, "kind": bson.M{"$ne": "refresh"}, "expiresAt": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var docs []mongoSessionDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(docs)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(js)
+}
+
+// revokeSession : logs a single session out, e.g. from a lost/stolen device.
+func revokeSession(res http.ResponseWriter, req *http.Request) {
+	userID, _, _ := identifyRequest(req)
+	sid := mux.Vars(req)["sid"]
+
+	ctx := context.Background()
+	_, err := DB.Collection("sessions").DeleteOne(ctx, bson.M{"sid": sid, "userID": userID})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, _ := json.Marshal(Response{true, "Session revoked."})
+	res.Write(response)
+}
+
 func register(res http.ResponseWriter, req *http.Request) {
 	// decoding userdata
 	decoder := json.NewDecoder(req.Body)
@@ -182,11 +246,13 @@ func register(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// hashing password
-	hashed, _ := bcrypt.GenerateFromPassword([]byte(postedUserData.Password), 12)
-	hashedConverted := string(hashed)
+	hashedPassword, hashError := defaultHasher.Hash(postedUserData.Password)
+	if hashError != nil {
+		log.Panicln(hashError)
+	}
 
 	// inserting user
-	creationResult, creationError := DB.Collection("users").InsertOne(ctx, bson.M{"email": postedUserData.Email, "password": hashedConverted})
+	creationResult, creationError := DB.Collection("users").InsertOne(ctx, bson.M{"email": postedUserData.Email, "password": hashedPassword, "emailVerified": false})
 	log.Println(creationResult)
 	if creationError != nil {
 		log.Panicln(creationError)
@@ -194,19 +260,34 @@ func register(res http.ResponseWriter, req *http.Request) {
 
 	log.Println("Registration successful.")
 
+	userID := creationResult.InsertedID.(primitive.ObjectID).Hex()
+	sendVerificationEmail(userID, postedUserData.Email)
+
 	// setting session data
 	session, _ := store.Get(req, "boiler-session")
 	session.Values["auth"] = true // now able to get users in the index page
-	session.Values["id"] = creationResult.InsertedID.(primitive.ObjectID).Hex()
+	session.Values["id"] = userID
 	session.Values["hasPassword"] = true
-	session.Values["Google"] = false
+	session.Values["providers"] = map[string]bool{}
+	session.Values["emailVerified"] = false
 
 	if err = sessions.Save(req, res); err != nil {
 		log.Printf("Error saving session: %v", err)
 	}
 
 	// sending a success response
-	response, err := json.Marshal(Response{true, "Successfully registered!"})
+	var response []byte
+	if wantsStatelessAuth(req) {
+		access, refresh, tokenErr := issueTokenPair(userID, map[string]bool{})
+		if tokenErr != nil {
+			log.Printf("Could not issue token pair: %v", tokenErr)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, err = json.Marshal(authResponse{Response{true, "Successfully registered!"}, access, refresh})
+	} else {
+		response, err = json.Marshal(Response{true, "Successfully registered!"})
+	}
 	if err != nil {
 		log.Println("Could not marshal response")
 	}
@@ -239,9 +320,10 @@ func authorize(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// checking password
-	comparisonError := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(postedUserData.Password))
-	if comparisonError != nil {
+	// checking password, using whichever hasher produced the stored hash
+	verifier := hasherFor(u.Password)
+	passwordValid, verifyError := verifier.Verify(postedUserData.Password, u.Password)
+	if verifyError != nil || !passwordValid {
 		log.Println("Login failed. Wrong password.")
 		response, _ := json.Marshal(Response{false, "Invalid login details!"})
 		res.WriteHeader(http.StatusUnauthorized)
@@ -249,7 +331,38 @@ func authorize(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// setting session data
+	// bcrypt logins migrate to argon2id opportunistically, without forcing a reset
+	if _, isBcrypt := verifier.(*bcryptHasher); isBcrypt {
+		if rehashed, rehashError := defaultHasher.Hash(postedUserData.Password); rehashError == nil {
+			if _, updateError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{"$set": bson.M{"password": rehashed}}); updateError != nil {
+				log.Println(updateError)
+			} else {
+				u.Password = rehashed
+			}
+		} else {
+			log.Println(rehashError)
+		}
+	}
+
+	if u.TwoFactor != nil && u.TwoFactor.Enabled {
+		challenge, err := issueTwoFactorChallenge(u.ID.Hex())
+		if err != nil {
+			log.Printf("Could not issue 2fa challenge: %v", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, _ := json.Marshal(twoFactorChallengeResponse{Response{false, "2fa_required"}, challenge})
+		res.Write(response)
+		return
+	}
+
+	completeLogin(res, req, u)
+}
+
+// completeLogin : finishes a login by setting up the cookie session and,
+// for stateless (mobile) clients, a token pair. Shared by authorize and the
+// /api/auth/2fa challenge handler so both paths end up in the same state.
+func completeLogin(res http.ResponseWriter, req *http.Request, u user) {
 	session, _ := store.Get(req, "boiler-session")
 	session.Values["auth"] = true // now able to get users in the index page
 	session.Values["id"] = u.ID.Hex()
@@ -260,18 +373,29 @@ func authorize(res http.ResponseWriter, req *http.Request) {
 		session.Values["hasPassword"] = false
 	}
 
-	if u.Google != nil {
-		session.Values["Google"] = true
-	} else {
-		session.Values["Google"] = false
-	}
+	session.Values["providers"] = linkedProviders(u)
+	session.Values["twoFactor"] = u.TwoFactor != nil && u.TwoFactor.Enabled
+	session.Values["emailVerified"] = u.EmailVerified
 
-	if err = sessions.Save(req, res); err != nil {
+	if err := sessions.Save(req, res); err != nil {
 		log.Printf("Error saving session: %v", err)
 	}
 
 	// sending a success response
-	response, err := json.Marshal(Response{true, "Successfully logged in!"})
+	var response []byte
+	var err error
+	if wantsStatelessAuth(req) {
+		var access, refresh string
+		access, refresh, err = issueTokenPair(u.ID.Hex(), linkedProviders(u))
+		if err != nil {
+			log.Printf("Could not issue token pair: %v", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, err = json.Marshal(authResponse{Response{true, "Successfully logged in!"}, access, refresh})
+	} else {
+		response, err = json.Marshal(Response{true, "Successfully logged in!"})
+	}
 	if err != nil {
 		log.Println("Could not marshal response")
 	}
@@ -313,11 +437,15 @@ func fetchSession(res http.ResponseWriter, req *http.Request) {
 		session.Values["hasPassword"] = false
 	}
 
-	if session.Values["Google"] == nil {
-		session.Values["Google"] = false
+	if session.Values["twoFactor"] == nil {
+		session.Values["twoFactor"] = false
+	}
+
+	if session.Values["emailVerified"] == nil {
+		session.Values["emailVerified"] = false
 	}
 
-	sessionData := SessionData{authStatus, session.Values["hasPassword"].(bool), session.Values["Google"].(bool)}
+	sessionData := SessionData{authStatus, session.Values["hasPassword"].(bool), sessionProviders(session), session.Values["twoFactor"].(bool), session.Values["emailVerified"].(bool)}
 	js, err := json.Marshal(sessionData)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -328,7 +456,31 @@ func fetchSession(res http.ResponseWriter, req *http.Request) {
 	res.Write(js)
 }
 
-func oauthGoogleRedirect(res http.ResponseWriter, req *http.Request) {
+// sessionProviders : returns the set of providers linked on the session, defaulting to none
+func sessionProviders(session *sessions.Session) map[string]bool {
+	linked, ok := session.Values["providers"].(map[string]bool)
+	if !ok {
+		linked = map[string]bool{}
+	}
+	return linked
+}
+
+// linkedProviders : builds the providers set for a user document fetched from the database
+func linkedProviders(u user) map[string]bool {
+	linked := map[string]bool{}
+	for name := range u.Providers {
+		linked[name] = true
+	}
+	return linked
+}
+
+func oauthRedirect(res http.ResponseWriter, req *http.Request) {
+	providerName := mux.Vars(req)["provider"]
+	provider, ok := providers[providerName]
+	if !ok {
+		http.NotFound(res, req)
+		return
+	}
 
 	keys, ok := req.URL.Query()["redirectUrl"]
 
@@ -338,47 +490,97 @@ func oauthGoogleRedirect(res http.ResponseWriter, req *http.Request) {
 	}
 	key := keys[0]
 
-	url := googleOauthConfig.AuthCodeURL(googleRandomState + "|" + string(key))
+	state := RandStringRunes(32)
+	verifier, challenge, err := newPKCEVerifier()
+	if err != nil {
+		log.Println("Could not generate PKCE verifier:", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := setOAuthStateCookie(res, state, verifier); err != nil {
+		log.Println("Could not set oauth state cookie:", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	url := provider.AuthCodeURL(state+"|"+key,
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
 	http.Redirect(res, req, url, http.StatusTemporaryRedirect)
 }
 
-func oauthGoogleUnlink(res http.ResponseWriter, req *http.Request) {
-	// setting session data
-	session, _ := store.Get(req, "boiler-session")
+func oauthUnlink(res http.ResponseWriter, req *http.Request) {
+	providerName := mux.Vars(req)["provider"]
+	if _, ok := providers[providerName]; !ok {
+		http.NotFound(res, req)
+		return
+	}
 
-	constructedUserID, _ := primitive.ObjectIDFromHex(session.Values["id"].(string))
+	userID, linked, _ := identifyRequest(req)
+	constructedUserID, _ := primitive.ObjectIDFromHex(userID)
 
-	if !session.Values["Google"].(bool) {
+	if !linked[providerName] {
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	ctx := context.Background()
-	_, unlinkError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"Google": bson.M{}}})
+	_, unlinkError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$unset": bson.M{"providers." + providerName: ""}})
 	if unlinkError != nil {
 		log.Println(unlinkError)
 	}
 
-	session.Values["Google"] = false
-	err := sessions.Save(req, res)
-	if err != nil {
-		log.Printf("Error saving session: %v", err)
+	delete(linked, providerName)
+
+	// bearer-authenticated clients carry their providers in the access
+	// token instead of a cookie session, so there's nothing to re-save.
+	if bearerToken(req) == "" {
+		session, _ := store.Get(req, "boiler-session")
+		session.Values["providers"] = linked
+		if err := sessions.Save(req, res); err != nil {
+			log.Printf("Error saving session: %v", err)
+		}
 	}
-	response, _ := json.Marshal(Response{true, "Successfully unlinked Google!"})
+	response, _ := json.Marshal(Response{true, fmt.Sprintf("Successfully unlinked %s!", providerName)})
 	res.Write(response)
 	return
 }
 
-func oauthGoogleCallback(res http.ResponseWriter, req *http.Request) {
-	// Read oauthState from Cookie
+func oauthCallback(res http.ResponseWriter, req *http.Request) {
+	providerName := mux.Vars(req)["provider"]
+	provider, ok := providers[providerName]
+	if !ok {
+		http.NotFound(res, req)
+		return
+	}
+
+	// Read oauthState from the signed, short-lived cookie set in oauthRedirect
+	stateCookie, err := readAndClearOAuthStateCookie(res, req)
+	if err != nil {
+		log.Println("invalid or expired oauth state cookie")
+		http.Redirect(res, req, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	receivedState := strings.Split(req.FormValue("state"), "|")[0]
+	if subtle.ConstantTimeCompare([]byte(receivedState), []byte(stateCookie.State)) != 1 {
+		log.Println("invalid oauth state")
+		http.Redirect(res, req, "/", http.StatusTemporaryRedirect)
+		return
+	}
 
-	if strings.Split(req.FormValue("state"), "|")[0] != googleRandomState {
-		log.Println("invalid oauth google state")
+	token, err := provider.Exchange(context.Background(), req.FormValue("code"),
+		oauth2.SetAuthURLParam("code_verifier", stateCookie.Verifier),
+	)
+	if err != nil {
+		log.Println(err.Error())
 		http.Redirect(res, req, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	data, err := getUserDataFromGoogle(req.FormValue("code"))
+	data, err := provider.FetchUserInfo(token)
 	if err != nil {
 		log.Println(err.Error())
 		http.Redirect(res, req, "/", http.StatusTemporaryRedirect)
@@ -387,19 +589,19 @@ func oauthGoogleCallback(res http.ResponseWriter, req *http.Request) {
 
 	// sending an OTC to the user.
 	// secured WebBrowser does not permit header modifications, and the
-	// Google redirect drops external headers as well. Storing this one-time-use token
+	// provider redirect drops external headers as well. Storing this one-time-use token
 	// for the user to access with their main (axios) session.
 	generatedOTC := RandStringRunes(15)
 
-	// storing data
+	// storing data, TTL-indexed (see ensureCacheIndexes) so unclaimed codes expire quickly
 	ctx := context.Background()
-	_, creationError := DB.Collection("cache").InsertOne(ctx, bson.M{"code": generatedOTC, "email": data.Email, "id": data.ID, "picture": data.Picture, "name": data.Name, "accessToken": req.FormValue("code")})
+	_, creationError := DB.Collection("cache").InsertOne(ctx, bson.M{"code": generatedOTC, "provider": providerName, "email": data.Email, "id": data.ID, "picture": data.Picture, "name": data.Name, "accessToken": data.AccessToken, "expiresAt": time.Now().Add(otcTTL)})
 	if creationError != nil {
 		log.Println("OTC Generation failed.")
 		log.Println(creationError)
 	}
 
-	http.Redirect(res, req, strings.Split(req.FormValue("state"), "|")[1]+"provider=google&success=true&code="+generatedOTC, http.StatusTemporaryRedirect)
+	http.Redirect(res, req, strings.Split(req.FormValue("state"), "|")[1]+"provider="+providerName+"&success=true&code="+generatedOTC, http.StatusTemporaryRedirect)
 }
 
 func oauthLink(res http.ResponseWriter, req *http.Request) {
@@ -413,11 +615,11 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 
 	res.Header().Set("Content-Type", "application/json")
 
-	// fetching cached data
+	// fetching cached data; deleting it on the way out makes the OTC single-use
 	ctx := context.Background()
-	foundCached := DB.Collection("cache").FindOne(ctx, bson.M{"code": dec.Code})
-	var data oauthUserData
-	decodeError := foundCached.Decode(&data)
+	foundCached := DB.Collection("cache").FindOneAndDelete(ctx, bson.M{"code": dec.Code})
+	var cached cachedOAuth
+	decodeError := foundCached.Decode(&cached)
 	if decodeError != nil {
 		log.Println(decodeError)
 		log.Println("Cache fetch failed. Can not link user oauth.")
@@ -427,6 +629,16 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	data := oauthUserData{Email: cached.Email, ID: cached.ID, Picture: cached.Picture, Name: cached.Name, AccessToken: cached.AccessToken}
+	providerName := cached.Provider
+	if _, ok := providers[providerName]; !ok {
+		log.Println("Unknown oauth provider in cache.")
+		response, _ := json.Marshal(Response{false, "Internal error."})
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write(response)
+		return
+	}
+
 	// setting session data
 	session, _ := store.Get(req, "boiler-session")
 
@@ -435,16 +647,16 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 	var decodedFound user
 	decodeError = foundUser.Decode(&decodedFound)
 
-	foundUserWithToken := DB.Collection("users").FindOne(ctx, bson.M{"Google.id": data.ID})
+	foundUserWithToken := DB.Collection("users").FindOne(ctx, bson.M{"providers." + providerName + ".id": data.ID})
 	var decodedFoundUserWithToken user
 	decodeErrorUserWithToken := foundUserWithToken.Decode(&decodedFoundUserWithToken)
 
 	if decodeErrorUserWithToken == nil {
 		if session.Values["auth"] != true {
-			log.Println("Logging user in via Google OAuth.")
+			log.Printf("Logging user in via %s OAuth.", providerName)
 			session.Values["auth"] = true // now able to get users in the index page
-			session.Values["id"] = decodedFoundUserWithToken.ID.String()
-			session.Values["Google"] = true
+			session.Values["id"] = decodedFoundUserWithToken.ID.Hex()
+			session.Values["providers"] = linkedProviders(decodedFoundUserWithToken)
 
 			if decodedFoundUserWithToken.Password != "" {
 				session.Values["hasPassword"] = true
@@ -461,8 +673,8 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		// user attempting to link account, but an user exists with this ID
-		log.Println("This Google account is already linked.")
-		response, _ := json.Marshal(Response{false, "This Google account is already linked."})
+		log.Printf("This %s account is already linked.", providerName)
+		response, _ := json.Marshal(Response{false, fmt.Sprintf("This %s account is already linked.", providerName)})
 		res.WriteHeader(http.StatusBadRequest)
 		res.Write(response)
 		return
@@ -473,7 +685,7 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 		ctx := context.Background()
 		constructedUserID, _ := primitive.ObjectIDFromHex(session.Values["id"].(string))
 
-		_, oauthLinkUpdateError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"Google": bson.M{"id": data.ID, "accessToken": data.AccessToken}, "profile": bson.M{"name": data.Name, "picture": data.Picture}}})
+		_, oauthLinkUpdateError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"providers." + providerName: bson.M{"id": data.ID, "accessToken": data.AccessToken}, "profile": bson.M{"name": data.Name, "picture": data.Picture}}})
 		if oauthLinkUpdateError != nil {
 			log.Println(oauthLinkUpdateError)
 			log.Println("OAuth link failed. Internal server error.")
@@ -483,7 +695,9 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		session.Values["Google"] = true
+		linked := sessionProviders(session)
+		linked[providerName] = true
+		session.Values["providers"] = linked
 		err = sessions.Save(req, res)
 		if err != nil {
 			log.Printf("Error saving session: %v", err)
@@ -509,7 +723,8 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// creating user...
-	creationResult, creationError := DB.Collection("users").InsertOne(ctx, bson.M{"email": data.Email, "Google": bson.M{"id": data.ID, "accessToken": data.AccessToken}, "profile": bson.M{"name": data.Name, "picture": data.Picture}})
+	// the provider already proved ownership of this email address
+	creationResult, creationError := DB.Collection("users").InsertOne(ctx, bson.M{"email": data.Email, "emailVerified": true, "providers": bson.M{providerName: bson.M{"id": data.ID, "accessToken": data.AccessToken}}, "profile": bson.M{"name": data.Name, "picture": data.Picture}})
 	log.Println(creationResult)
 
 	if creationError != nil {
@@ -519,8 +734,9 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 	// setting session values
 	session.Values["auth"] = true // now able to get users in the index page
 	session.Values["id"] = creationResult.InsertedID.(primitive.ObjectID).Hex()
-	session.Values["Google"] = true
+	session.Values["providers"] = map[string]bool{providerName: true}
 	session.Values["hasPassword"] = false
+	session.Values["emailVerified"] = true
 
 	err = sessions.Save(req, res)
 	if err != nil {
@@ -535,31 +751,6 @@ func oauthLink(res http.ResponseWriter, req *http.Request) {
 	res.Write(response)
 }
 
-func getUserDataFromGoogle(code string) (result oauthUserData, e error) {
-	// Use code to get token and get user info from Google.
-	var receivedGoogleData oauthUserData
-
-	token, err := googleOauthConfig.Exchange(context.Background(), code)
-	if err != nil {
-		return receivedGoogleData, fmt.Errorf("code exchange wrong: %s", err.Error())
-	}
-
-	response, err := http.Get(oauthGoogleURLAPI + token.AccessToken)
-	if err != nil {
-		return receivedGoogleData, fmt.Errorf("failed getting user info: %s", err.Error())
-	}
-	defer response.Body.Close()
-
-	// retrieving user id
-	decoder := json.NewDecoder(response.Body)
-	decoder.Decode(&receivedGoogleData)
-
-	if err != nil {
-		return receivedGoogleData, fmt.Errorf("failed read response: %s", err.Error())
-	}
-	return receivedGoogleData, nil
-}
-
 func changePassword(res http.ResponseWriter, req *http.Request) {
 	// decoding passwordchange data
 	decoder := json.NewDecoder(req.Body)
@@ -569,11 +760,11 @@ func changePassword(res http.ResponseWriter, req *http.Request) {
 		log.Panicln(err)
 	}
 
-	session, _ := store.Get(req, "boiler-session")
+	userID, _, _ := identifyRequest(req)
 
 	// fetching user
 	ctx := context.Background()
-	constructedUserID, _ := primitive.ObjectIDFromHex(session.Values["id"].(string))
+	constructedUserID, _ := primitive.ObjectIDFromHex(userID)
 	foundUser := DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID})
 	var u user
 	decodeError := foundUser.Decode(&u)
@@ -587,8 +778,8 @@ func changePassword(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// checking password
-	comparisonError := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(postedPasswordChangeData.OldPassword))
-	if comparisonError != nil {
+	passwordValid, verifyError := hasherFor(u.Password).Verify(postedPasswordChangeData.OldPassword, u.Password)
+	if verifyError != nil || !passwordValid {
 		log.Println("Password change failed. Incorrect old password.")
 		response, _ := json.Marshal(Response{false, "Wrong old password!"})
 		res.WriteHeader(http.StatusUnauthorized)
@@ -597,11 +788,15 @@ func changePassword(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// hashing password
-	hashed, _ := bcrypt.GenerateFromPassword([]byte(postedPasswordChangeData.NewPassword), 12)
-	hashedConverted := string(hashed)
+	hashedPassword, hashError := defaultHasher.Hash(postedPasswordChangeData.NewPassword)
+	if hashError != nil {
+		log.Println(hashError)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	// inserting user
-	_, passwordChangeError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"password": hashedConverted}})
+	_, passwordChangeError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"password": hashedPassword}})
 	if passwordChangeError != nil {
 		log.Println(passwordChangeError)
 		log.Println("Password change failed. Internal server error.")
@@ -630,11 +825,45 @@ func onlyUnauthorized(next http.Handler) http.Handler {
 
 func onlyAuthorized(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		session, _ := store.Get(req, "boiler-session")
-		if session.Values["auth"] == nil || session.Values["auth"].(bool) == false {
+		if _, _, ok := identifyRequest(req); !ok {
 			res.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		next.ServeHTTP(res, req)
 	})
 }
+
+// onlyVerified : like onlyAuthorized, but also requires the account's email
+// to be verified - for routes that shouldn't be reachable by half-signed-up accounts.
+func onlyVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		userID, _, ok := identifyRequest(req)
+		if !ok {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		constructedUserID, err := primitive.ObjectIDFromHex(userID)
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.Background()
+		foundUser := DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID})
+		var u user
+		if decodeError := foundUser.Decode(&u); decodeError != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !u.EmailVerified {
+			res.WriteHeader(http.StatusForbidden)
+			response, _ := json.Marshal(Response{false, "Please verify your email address first."})
+			res.Write(response)
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
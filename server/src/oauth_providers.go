@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/facebook"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+const oauthGoogleURLAPI = "https://www.googleapis.com/oauth2/v2/userinfo?access_token="
+const oauthFacebookURLAPI = "https://graph.facebook.com/me?fields=id,name,email,picture&access_token="
+const oauthGithubURLAPI = "https://api.github.com/user"
+
+// OAuthProvider : a single social login provider registered with the app.
+// Concrete providers wrap an *oauth2.Config and know how to turn an
+// exchanged token into a normalized oauthUserData.
+type OAuthProvider interface {
+	Name() string
+	AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string
+	Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	FetchUserInfo(token *oauth2.Token) (oauthUserData, error)
+}
+
+// providers : registry of every OAuthProvider, keyed by the name used in
+// routes (e.g. "/auth/google") and in user.Providers.
+var providers map[string]OAuthProvider
+
+func init() {
+	providers = map[string]OAuthProvider{}
+
+	providers["google"] = &googleProvider{config: &oauth2.Config{
+		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
+		Endpoint:     google.Endpoint,
+	}}
+
+	providers["facebook"] = &facebookProvider{config: &oauth2.Config{
+		RedirectURL:  os.Getenv("FACEBOOK_REDIRECT_URL"),
+		ClientID:     os.Getenv("FACEBOOK_CLIENT_ID"),
+		ClientSecret: os.Getenv("FACEBOOK_CLIENT_SECRET"),
+		Scopes:       []string{"email", "public_profile"},
+		Endpoint:     facebook.Endpoint,
+	}}
+
+	providers["github"] = &githubProvider{config: &oauth2.Config{
+		RedirectURL:  os.Getenv("GITHUB_REDIRECT_URL"),
+		ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
+		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		Scopes:       []string{"read:user", "user:email"},
+		Endpoint:     github.Endpoint,
+	}}
+}
+
+type googleProvider struct {
+	config *oauth2.Config
+}
+
+func (p *googleProvider) Name() string { return "google" }
+
+func (p *googleProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *googleProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *googleProvider) FetchUserInfo(token *oauth2.Token) (oauthUserData, error) {
+	var data oauthUserData
+
+	response, err := http.Get(oauthGoogleURLAPI + token.AccessToken)
+	if err != nil {
+		return data, fmt.Errorf("failed getting user info: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(&data); err != nil {
+		return data, fmt.Errorf("failed read response: %s", err.Error())
+	}
+
+	data.AccessToken = token.AccessToken
+	return data, nil
+}
+
+type facebookProvider struct {
+	config *oauth2.Config
+}
+
+func (p *facebookProvider) Name() string { return "facebook" }
+
+func (p *facebookProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *facebookProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *facebookProvider) FetchUserInfo(token *oauth2.Token) (oauthUserData, error) {
+	var data oauthUserData
+
+	response, err := http.Get(oauthFacebookURLAPI + token.AccessToken)
+	if err != nil {
+		return data, fmt.Errorf("failed getting user info: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	var facebookUser struct {
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Email   string `json:"email"`
+		Picture struct {
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"picture"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&facebookUser); err != nil {
+		return data, fmt.Errorf("failed read response: %s", err.Error())
+	}
+
+	data.ID = facebookUser.ID
+	data.Name = facebookUser.Name
+	data.Email = facebookUser.Email
+	data.Picture = facebookUser.Picture.Data.URL
+	data.AccessToken = token.AccessToken
+	return data, nil
+}
+
+type githubProvider struct {
+	config *oauth2.Config
+}
+
+func (p *githubProvider) Name() string { return "github" }
+
+func (p *githubProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *githubProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *githubProvider) FetchUserInfo(token *oauth2.Token) (oauthUserData, error) {
+	var data oauthUserData
+
+	req, err := http.NewRequest("GET", oauthGithubURLAPI, nil)
+	if err != nil {
+		return data, fmt.Errorf("failed building github request: %s", err.Error())
+	}
+	req.Header.Set("Authorization", "token "+token.AccessToken)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return data, fmt.Errorf("failed getting user info: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	var githubUser struct {
+		ID        int    `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&githubUser); err != nil {
+		return data, fmt.Errorf("failed read response: %s", err.Error())
+	}
+
+	data.ID = strconv.Itoa(githubUser.ID)
+	data.Name = githubUser.Name
+	if data.Name == "" {
+		data.Name = githubUser.Login
+	}
+	data.Email = githubUser.Email
+	data.Picture = githubUser.AvatarURL
+	data.AccessToken = token.AccessToken
+
+	// GitHub returns a null email on /user whenever the account has a
+	// private email address, even with the user:email scope - fall back to
+	// /user/emails for the primary, verified address in that case.
+	if data.Email == "" {
+		email, err := p.fetchPrimaryEmail(token)
+		if err != nil {
+			return data, err
+		}
+		data.Email = email
+	}
+
+	return data, nil
+}
+
+func (p *githubProvider) fetchPrimaryEmail(token *oauth2.Token) (string, error) {
+	req, err := http.NewRequest("GET", oauthGithubURLAPI+"/emails", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed building github emails request: %s", err.Error())
+	}
+	req.Header.Set("Authorization", "token "+token.AccessToken)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed getting github emails: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&emails); err != nil {
+		return "", fmt.Errorf("failed read github emails response: %s", err.Error())
+	}
+
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", nil
+}
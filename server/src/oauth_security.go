@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOptions "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// otcTTL : how long an OAuth OTC lives in the "cache" collection before the
+// TTL index (see ensureCacheIndexes) reaps it.
+const otcTTL = 60 * time.Second
+
+const oauthStateCookieName = "oauth-state"
+const oauthStateCookieMaxAge = 300 // 5 minutes, just long enough for the provider round trip
+
+// oauthStateCookie : what's signed into the short-lived cookie set by
+// oauthRedirect and read back by oauthCallback - a fresh-per-request CSRF
+// state plus the PKCE verifier matching the code_challenge sent upstream.
+type oauthStateCookie struct {
+	State    string
+	Verifier string
+}
+
+var oauthStateCodec = securecookie.New([]byte(os.Getenv("OAUTH_STATE_SECRET1")), []byte(os.Getenv("OAUTH_STATE_SECRET2")))
+
+func init() {
+	oauthStateCodec.MaxAge(oauthStateCookieMaxAge)
+}
+
+// newPKCEVerifier : a random code_verifier plus its S256 code_challenge, per RFC 7636.
+func newPKCEVerifier() (verifier string, challenge string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(raw)
+
+	sum := sha256.Sum256([]byte(verifier))
+	challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	return verifier, challenge, nil
+}
+
+func setOAuthStateCookie(res http.ResponseWriter, state string, verifier string) error {
+	encoded, err := oauthStateCodec.Encode(oauthStateCookieName, oauthStateCookie{State: state, Verifier: verifier})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   oauthStateCookieMaxAge,
+		HttpOnly: true,
+	})
+	return nil
+}
+
+// readAndClearOAuthStateCookie : reads the state cookie and immediately
+// expires it, since it's only ever meant to survive one callback.
+func readAndClearOAuthStateCookie(res http.ResponseWriter, req *http.Request) (oauthStateCookie, error) {
+	var data oauthStateCookie
+
+	cookie, err := req.Cookie(oauthStateCookieName)
+	if err != nil {
+		return data, err
+	}
+
+	if err := oauthStateCodec.Decode(oauthStateCookieName, cookie.Value, &data); err != nil {
+		return data, err
+	}
+
+	http.SetCookie(res, &http.Cookie{Name: oauthStateCookieName, Value: "", Path: "/", MaxAge: -1})
+	return data, nil
+}
+
+// ensureCacheIndexes : TTL-indexes the "cache" collection so OAuth OTCs expire
+// on their own instead of only being cleared on server startup.
+func ensureCacheIndexes(ctx context.Context) {
+	_, err := DB.Collection("cache").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: mongoOptions.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Println("Could not create cache TTL index:", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher : lets register/authorize/changePassword work with whatever
+// hashing scheme produced a stored password, instead of hardcoding bcrypt.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encodedHash string) (bool, error)
+}
+
+// defaultHasher : every newly set password goes through this one.
+var defaultHasher PasswordHasher = newArgon2Hasher()
+
+// hasherFor : picks the verifier matching an existing stored hash, so
+// bcrypt-hashed passwords from before this change keep working.
+func hasherFor(encodedHash string) PasswordHasher {
+	if strings.HasPrefix(encodedHash, "$argon2id$") {
+		return newArgon2Hasher()
+	}
+	return newBcryptHasher()
+}
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32 // KiB
+	threads uint8
+	saltLen uint32
+	keyLen  uint32
+}
+
+func defaultArgon2Params() argon2Params {
+	return argon2Params{
+		time:    envUint32("ARGON2_TIME", 3),
+		memory:  envUint32("ARGON2_MEMORY_KB", 64*1024),
+		threads: uint8(envUint32("ARGON2_THREADS", 4)),
+		saltLen: 16,
+		keyLen:  32,
+	}
+}
+
+func envUint32(name string, fallback uint32) uint32 {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return fallback
+	}
+	return uint32(parsed)
+}
+
+// argon2Hasher : Argon2id, PHC-string encoded
+// ($argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>).
+type argon2Hasher struct {
+	params argon2Params
+}
+
+func newArgon2Hasher() *argon2Hasher {
+	return &argon2Hasher{params: defaultArgon2Params()}
+}
+
+func (h *argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.time, h.params.memory, h.params.threads, h.params.keyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.memory, h.params.time, h.params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *argon2Hasher) Verify(password, encodedHash string) (bool, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, err
+	}
+
+	var memory, timeCost uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &timeCost, &threads); err != nil {
+		return false, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	expectedKey, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	computedKey := argon2.IDKey([]byte(password), salt, timeCost, memory, threads, uint32(len(expectedKey)))
+	return subtle.ConstantTimeCompare(computedKey, expectedKey) == 1, nil
+}
+
+// bcryptHasher : kept only to verify passwords hashed before the argon2id
+// migration; authorize() re-hashes these with argon2id on successful login.
+type bcryptHasher struct {
+	cost int
+}
+
+func newBcryptHasher() *bcryptHasher {
+	return &bcryptHasher{cost: 12}
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hashed), err
+}
+
+func (h *bcryptHasher) Verify(password, encodedHash string) (bool, error) {
+	if err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
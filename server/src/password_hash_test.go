@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// minVerifyLatency : the minimum cost Argon2id verification must impose,
+// overridable via PASSWORD_HASH_MIN_VERIFY_MS so CI can tune it per runner.
+// This is a floor, not a budget: it exists to catch someone accidentally
+// weakening ARGON2_TIME/ARGON2_MEMORY_KB to an insecurely cheap cost, not to
+// flag verification being slow.
+func minVerifyLatency() time.Duration {
+	if v := os.Getenv("PASSWORD_HASH_MIN_VERIFY_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return 50 * time.Millisecond
+}
+
+func TestArgon2VerifyLatency(t *testing.T) {
+	hasher := newArgon2Hasher()
+
+	encoded, err := hasher.Hash("a reasonably strong password")
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+
+	start := time.Now()
+	ok, err := hasher.Verify("a reasonably strong password", encoded)
+	elapsed := time.Since(start)
+
+	if err != nil || !ok {
+		t.Fatalf("Verify failed: ok=%v err=%v", ok, err)
+	}
+
+	if floor := minVerifyLatency(); elapsed < floor {
+		t.Fatalf("argon2id verification took only %s, under the %s floor (ARGON2_TIME/ARGON2_MEMORY_KB may have been weakened; tune PASSWORD_HASH_MIN_VERIFY_MS if this runner is just fast)", elapsed, floor)
+	}
+}
+
+func BenchmarkArgon2Verify(b *testing.B) {
+	hasher := newArgon2Hasher()
+	encoded, err := hasher.Hash("a reasonably strong password")
+	if err != nil {
+		b.Fatalf("Hash failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hasher.Verify("a reasonably strong password", encoded); err != nil {
+			b.Fatalf("Verify failed: %v", err)
+		}
+	}
+}
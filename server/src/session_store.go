@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongoOptions "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoSessionDoc : a row in the "sessions" collection. Cookie sessions and
+// stateless refresh tokens (see stateless_auth.go) share this collection,
+// distinguished by Kind.
+type mongoSessionDoc struct {
+	SID              string          `json:"sid" bson:"sid"`
+	Kind             string          `json:"-" bson:"kind,omitempty"`
+	UserID           string          `json:"userID" bson:"userID"`
+	Providers        map[string]bool `json:"providers" bson:"providers"`
+	RefreshTokenHash string          `json:"-" bson:"refreshTokenHash,omitempty"`
+	CreatedAt        time.Time       `json:"createdAt" bson:"createdAt"`
+	ExpiresAt        time.Time       `json:"expiresAt" bson:"expiresAt"`
+	LastSeen         time.Time       `json:"lastSeen" bson:"lastSeen"`
+}
+
+// mongoStore : a gorilla sessions.Store backed by the "sessions" collection,
+// so login state lives server-side and can be listed/revoked via
+// /api/sessions instead of only disappearing when the cookie expires.
+type mongoStore struct {
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+func newMongoStore(keyPairs ...[]byte) *mongoStore {
+	return &mongoStore{
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   3600 * 8, // 8 hours
+			HttpOnly: true,
+		},
+	}
+}
+
+func (s *mongoStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(s, name)
+}
+
+func (s *mongoStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var sid string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &sid, s.codecs...); err != nil {
+		return session, nil
+	}
+
+	ctx := context.Background()
+	var doc mongoSessionDoc
+	findErr := DB.Collection("sessions").FindOne(ctx, bson.M{"sid": sid, "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&doc)
+	if findErr != nil {
+		return session, nil
+	}
+
+	session.ID = sid
+	session.IsNew = false
+	session.Values["auth"] = true
+	session.Values["id"] = doc.UserID
+	session.Values["providers"] = doc.Providers
+	if session.Values["providers"] == nil {
+		session.Values["providers"] = map[string]bool{}
+	}
+
+	// hasPassword/twoFactor/emailVerified are properties of the account, not
+	// of the session doc - re-derive them from the user document on every
+	// restore instead of trusting a stale copy, so /api/session is correct
+	// even on the very first request after login.
+	session.Values["hasPassword"] = false
+	session.Values["twoFactor"] = false
+	session.Values["emailVerified"] = false
+	if constructedUserID, idErr := primitive.ObjectIDFromHex(doc.UserID); idErr == nil {
+		var u user
+		if DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID}).Decode(&u) == nil {
+			session.Values["hasPassword"] = u.Password != ""
+			session.Values["twoFactor"] = u.TwoFactor != nil && u.TwoFactor.Enabled
+			session.Values["emailVerified"] = u.EmailVerified
+		}
+	}
+
+	DB.Collection("sessions").UpdateOne(ctx, bson.M{"sid": sid}, bson.M{"$set": bson.M{"lastSeen": time.Now()}})
+
+	return session, nil
+}
+
+func (s *mongoStore) Save(req *http.Request, res http.ResponseWriter, session *sessions.Session) error {
+	ctx := context.Background()
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			DB.Collection("sessions").DeleteOne(ctx, bson.M{"sid": session.ID})
+		}
+		http.SetCookie(res, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	auth, _ := session.Values["auth"].(bool)
+	if auth {
+		if session.ID == "" {
+			session.ID = RandStringRunes(32)
+		}
+
+		userID, _ := session.Values["id"].(string)
+		providers, _ := session.Values["providers"].(map[string]bool)
+		now := time.Now()
+
+		_, err := DB.Collection("sessions").UpdateOne(ctx,
+			bson.M{"sid": session.ID},
+			bson.M{
+				"$set":         bson.M{"userID": userID, "providers": providers, "expiresAt": now.Add(time.Duration(session.Options.MaxAge) * time.Second), "lastSeen": now},
+				"$setOnInsert": bson.M{"createdAt": now},
+			},
+			mongoOptions.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(res, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const accessTokenTTL = 15 * time.Minute
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// accessClaims : the claims carried by the short-lived bearer token mobile
+// clients use in place of the "boiler-session" cookie.
+type accessClaims struct {
+	jwt.StandardClaims
+	Providers map[string]bool `json:"providers"`
+}
+
+// authResponse : a Response that also carries a token pair, returned when a
+// login/register request opts into stateless auth.
+type authResponse struct {
+	Response
+	AccessToken  string `json:"accessToken,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+// wantsStatelessAuth : opt-in so cookie-based clients are unaffected
+func wantsStatelessAuth(req *http.Request) bool {
+	return req.URL.Query().Get("stateless") == "true"
+}
+
+func issueAccessToken(userID string, providers map[string]bool) (string, error) {
+	claims := accessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   userID,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(accessTokenTTL).Unix(),
+		},
+		Providers: providers,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+func parseAccessToken(tokenString string) (*accessClaims, error) {
+	if tokenString == "" {
+		return nil, fmt.Errorf("no token provided")
+	}
+
+	claims := &accessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid access token")
+	}
+
+	return claims, nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokenPair : mints an access token plus a rotating refresh token,
+// persisting the refresh token (hashed) as a "refresh" row in the sessions
+// collection so it can be revoked the same way a cookie session can.
+func issueTokenPair(userID string, providers map[string]bool) (access string, refresh string, err error) {
+	access, err = issueAccessToken(userID, providers)
+	if err != nil {
+		return "", "", err
+	}
+
+	refresh = RandStringRunes(48)
+	now := time.Now()
+
+	ctx := context.Background()
+	_, err = DB.Collection("sessions").InsertOne(ctx, mongoSessionDoc{
+		SID:              "refresh:" + RandStringRunes(16),
+		Kind:             "refresh",
+		UserID:           userID,
+		Providers:        providers,
+		RefreshTokenHash: hashRefreshToken(refresh),
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(refreshTokenTTL),
+		LastSeen:         now,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return access, refresh, nil
+}
+
+// rotateRefreshToken : consumes a refresh token (single-use) and issues a new pair.
+func rotateRefreshToken(refreshToken string) (access string, refresh string, err error) {
+	ctx := context.Background()
+
+	var doc mongoSessionDoc
+	findErr := DB.Collection("sessions").FindOne(ctx, bson.M{"kind": "refresh", "refreshTokenHash": hashRefreshToken(refreshToken), "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&doc)
+	if findErr != nil {
+		return "", "", fmt.Errorf("invalid refresh token")
+	}
+
+	DB.Collection("sessions").DeleteOne(ctx, bson.M{"sid": doc.SID})
+
+	return issueTokenPair(doc.UserID, doc.Providers)
+}
+
+func refreshTokenHandler(res http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var body struct {
+		RefreshToken string
+	}
+	if err := decoder.Decode(&body); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	access, refresh, err := rotateRefreshToken(body.RefreshToken)
+	if err != nil {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	response, _ := json.Marshal(authResponse{Response{true, "Token refreshed."}, access, refresh})
+	res.Write(response)
+}
+
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// identifyRequest : resolves the caller's user id + linked providers from
+// either a bearer access token or the "boiler-session" cookie, so
+// onlyAuthorized (and handlers needing the user id) work for both.
+func identifyRequest(req *http.Request) (userID string, providers map[string]bool, ok bool) {
+	if claims, err := parseAccessToken(bearerToken(req)); err == nil {
+		return claims.Subject, claims.Providers, true
+	}
+
+	session, _ := store.Get(req, "boiler-session")
+	auth, _ := session.Values["auth"].(bool)
+	if !auth {
+		return "", nil, false
+	}
+
+	id, _ := session.Values["id"].(string)
+	return id, sessionProviders(session), true
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const totpStepSeconds = 30
+const totpDigits = 6
+const totpDriftSteps = 1
+const recoveryCodeCount = 10
+const twoFactorChallengeTTL = 5 * time.Minute
+
+// twoFactorData : 2FA enrollment state kept on the user document.
+type twoFactorData struct {
+	Enabled       bool           `json:"enabled" bson:"enabled"`
+	Secret        string         `json:"-" bson:"secret,omitempty"`
+	RecoveryCodes []recoveryCode `json:"-" bson:"recoveryCodes,omitempty"`
+}
+
+// recoveryCode : a single-use backup code, stored hashed like a password.
+type recoveryCode struct {
+	Hash string `bson:"hash"`
+	Used bool   `bson:"used"`
+}
+
+type twoFactorChallengeResponse struct {
+	Response
+	Challenge string `json:"challenge"`
+}
+
+type twoFactorChallengeClaims struct {
+	jwt.StandardClaims
+}
+
+// issueTwoFactorChallenge : a short-lived token naming the user who passed
+// the password check but still needs to prove possession of their TOTP
+// device, so /api/auth/2fa doesn't have to re-accept a password.
+func issueTwoFactorChallenge(userID string) (string, error) {
+	claims := twoFactorChallengeClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   userID,
+			Audience:  "2fa_challenge",
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(twoFactorChallengeTTL).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+func parseTwoFactorChallenge(tokenString string) (userID string, err error) {
+	claims := &twoFactorChallengeClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !token.Valid || claims.Audience != "2fa_challenge" {
+		return "", fmt.Errorf("invalid or expired 2fa challenge")
+	}
+	return claims.Subject, nil
+}
+
+// generateTOTPSecret : a 20-byte (160-bit) secret, base32 encoded per RFC 4648 (no padding).
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw), nil
+}
+
+// totpAt : RFC 6238 TOTP over HMAC-SHA1, with the 30-second step folded into
+// a big-endian 8-byte counter and truncated per RFC 4226 section 5.3.
+func totpAt(secret string, t time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %s", err.Error())
+	}
+
+	counter := uint64(t.Unix() / totpStepSeconds)
+	counterBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(counterBytes, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counterBytes)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := (uint32(sum[offset])&0x7f)<<24 |
+		uint32(sum[offset+1])<<16 |
+		uint32(sum[offset+2])<<8 |
+		uint32(sum[offset+3])
+
+	code := truncated % 1000000
+	return fmt.Sprintf("%0*d", totpDigits, code), nil
+}
+
+// verifyTOTP : accepts the current 30s step plus one step of drift either way.
+func verifyTOTP(secret string, code string) bool {
+	now := time.Now()
+	for drift := -totpDriftSteps; drift <= totpDriftSteps; drift++ {
+		expected, err := totpAt(secret, now.Add(time.Duration(drift*totpStepSeconds)*time.Second))
+		if err != nil {
+			return false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateRecoveryCodes : returns the plaintext codes (shown to the user once)
+// alongside the hashed form that gets persisted.
+func generateRecoveryCodes() (plaintext []string, hashed []recoveryCode, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := RandStringRunes(10)
+		hash, hashErr := bcrypt.GenerateFromPassword([]byte(code), 10)
+		if hashErr != nil {
+			return nil, nil, hashErr
+		}
+		plaintext = append(plaintext, code)
+		hashed = append(hashed, recoveryCode{Hash: string(hash), Used: false})
+	}
+	return plaintext, hashed, nil
+}
+
+// consumeRecoveryCode : marks a matching, unused recovery code as used. Returns
+// false if no matching unused code is found.
+func consumeRecoveryCode(codes []recoveryCode, code string) (updated []recoveryCode, ok bool) {
+	for i := range codes {
+		if codes[i].Used {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(codes[i].Hash), []byte(code)) == nil {
+			codes[i].Used = true
+			return codes, true
+		}
+	}
+	return codes, false
+}
+
+// verifyTwoFactorProof : reads a {Code, Password} body and reports whether
+// either one proves the caller still holds the enabled factor, so an
+// already-enabled twoFactor record can't be re-enrolled over or disabled by
+// a bare authenticated session alone (a hijacked cookie, leaked bearer
+// token, or CSRF should not be enough to strip 2FA protection).
+func verifyTwoFactorProof(req *http.Request, u user) bool {
+	decoder := json.NewDecoder(req.Body)
+	var body struct {
+		Code     string
+		Password string
+	}
+	if err := decoder.Decode(&body); err != nil {
+		log.Panicln(err)
+	}
+
+	if body.Code != "" && verifyTOTP(u.TwoFactor.Secret, body.Code) {
+		return true
+	}
+	if body.Password != "" {
+		ok, _ := hasherFor(u.Password).Verify(body.Password, u.Password)
+		return ok
+	}
+	return false
+}
+
+func enroll2FA(res http.ResponseWriter, req *http.Request) {
+	userID, _, _ := identifyRequest(req)
+	constructedUserID, _ := primitive.ObjectIDFromHex(userID)
+
+	res.Header().Set("Content-Type", "application/json")
+
+	ctx := context.Background()
+	var u user
+	if err := DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID}).Decode(&u); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// re-enrolling over an already-enabled factor would silently disable 2FA
+	// and wipe the recovery codes, so require proof the caller still holds
+	// the current factor (or the password) before touching it.
+	if u.TwoFactor != nil && u.TwoFactor.Enabled && !verifyTwoFactorProof(req, u) {
+		response, _ := json.Marshal(Response{false, "Re-enrolling 2FA requires your current code or password."})
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write(response)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the secret isn't enabled until /api/2fa/verify confirms the user's
+	// authenticator app actually produces matching codes.
+	_, updateError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"twoFactor": twoFactorData{Enabled: false, Secret: secret}}})
+	if updateError != nil {
+		log.Println(updateError)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	otpauthURL := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s", url.PathEscape("Boiler"), url.PathEscape(u.Email), secret, url.QueryEscape("Boiler"))
+
+	js, _ := json.Marshal(struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauthUrl"`
+	}{secret, otpauthURL})
+	res.Write(js)
+}
+
+func verify2FAEnrollment(res http.ResponseWriter, req *http.Request) {
+	userID, _, _ := identifyRequest(req)
+	constructedUserID, _ := primitive.ObjectIDFromHex(userID)
+
+	res.Header().Set("Content-Type", "application/json")
+
+	decoder := json.NewDecoder(req.Body)
+	var body struct{ Code string }
+	if err := decoder.Decode(&body); err != nil {
+		log.Panicln(err)
+	}
+
+	ctx := context.Background()
+	var u user
+	if err := DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID}).Decode(&u); err != nil || u.TwoFactor == nil {
+		response, _ := json.Marshal(Response{false, "2FA has not been enrolled."})
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write(response)
+		return
+	}
+
+	if !verifyTOTP(u.TwoFactor.Secret, body.Code) {
+		response, _ := json.Marshal(Response{false, "Invalid code."})
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write(response)
+		return
+	}
+
+	plaintextCodes, hashedCodes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, updateError := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"twoFactor.enabled": true, "twoFactor.recoveryCodes": hashedCodes}})
+	if updateError != nil {
+		log.Println(updateError)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Response
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{Response{true, "2FA enabled."}, plaintextCodes})
+	res.Write(js)
+}
+
+func disable2FA(res http.ResponseWriter, req *http.Request) {
+	userID, _, _ := identifyRequest(req)
+	constructedUserID, _ := primitive.ObjectIDFromHex(userID)
+
+	res.Header().Set("Content-Type", "application/json")
+
+	ctx := context.Background()
+	var u user
+	if err := DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID}).Decode(&u); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// disabling 2FA is as sensitive as re-enrolling over it - a bare
+	// authenticated session isn't enough proof on its own.
+	if u.TwoFactor != nil && u.TwoFactor.Enabled && !verifyTwoFactorProof(req, u) {
+		response, _ := json.Marshal(Response{false, "Disabling 2FA requires your current code or password."})
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write(response)
+		return
+	}
+
+	_, err := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$unset": bson.M{"twoFactor": ""}})
+	if err != nil {
+		log.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response, _ := json.Marshal(Response{true, "2FA disabled."})
+	res.Write(response)
+}
+
+// completeTwoFactorLogin : the second step of login once authorize has
+// returned a "2fa_required" challenge - verifies a TOTP code (or consumes a
+// recovery code) and, on success, finishes the login exactly like authorize
+// would have for a user without 2FA enabled.
+func completeTwoFactorLogin(res http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var body struct {
+		Challenge string
+		Code      string
+	}
+	if err := decoder.Decode(&body); err != nil {
+		log.Panicln(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+
+	userID, err := parseTwoFactorChallenge(body.Challenge)
+	if err != nil {
+		response, _ := json.Marshal(Response{false, "Invalid or expired challenge."})
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write(response)
+		return
+	}
+
+	constructedUserID, _ := primitive.ObjectIDFromHex(userID)
+
+	ctx := context.Background()
+	var u user
+	if err := DB.Collection("users").FindOne(ctx, bson.M{"_id": constructedUserID}).Decode(&u); err != nil || u.TwoFactor == nil || !u.TwoFactor.Enabled {
+		response, _ := json.Marshal(Response{false, "Invalid login details!"})
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write(response)
+		return
+	}
+
+	if verifyTOTP(u.TwoFactor.Secret, body.Code) {
+		completeLogin(res, req, u)
+		return
+	}
+
+	updatedCodes, ok := consumeRecoveryCode(u.TwoFactor.RecoveryCodes, body.Code)
+	if !ok {
+		response, _ := json.Marshal(Response{false, "Invalid code."})
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write(response)
+		return
+	}
+
+	if _, err := DB.Collection("users").UpdateOne(ctx, bson.M{"_id": constructedUserID}, bson.M{"$set": bson.M{"twoFactor.recoveryCodes": updatedCodes}}); err != nil {
+		log.Println(err)
+	}
+
+	completeLogin(res, req, u)
+}